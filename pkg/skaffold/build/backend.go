@@ -0,0 +1,142 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package build declares the backend-agnostic interface that every image
+// builder implementation (docker, podman, buildah, kaniko, ...) satisfies,
+// so the rest of skaffold can build, push and inspect images without caring
+// which tool actually produces them.
+package build
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"time"
+)
+
+// Backend builds, pushes, and inspects images for one particular build tool.
+type Backend interface {
+	// Build produces an image described by opts and tags it opts.ImageName.
+	Build(ctx context.Context, opts *Options) error
+	// Push uploads the image referenced by ref to its registry.
+	Push(ctx context.Context, ref string, out io.Writer) error
+	// Digest returns the image ID/digest for ref. Whether a ref that isn't
+	// present locally yields "" or an error depends on the backend.
+	Digest(ctx context.Context, ref string) (string, error)
+	// Inspect returns metadata about ref as known to this backend.
+	Inspect(ctx context.Context, ref string) (ImageInfo, error)
+}
+
+// Options is the backend-agnostic equivalent of docker.BuildOptions.
+type Options struct {
+	ImageName   string
+	Dockerfile  string
+	ContextDir  string
+	BuildArgs   map[string]*string
+	Target      string
+	ProgressBuf io.Writer
+	BuildBuf    io.Writer
+
+	// EventHandler, if set, receives a structured Event per line of build
+	// output in addition to whatever is written to BuildBuf. Unlike
+	// docker.BuildOptions.EventHandler, this is the lowest common denominator
+	// every Backend can report: backends that shell out to another CLI
+	// (podman, buildah) or stream pod logs (kaniko) only ever see build
+	// output as lines of text, so beyond a BuildFailed message that's all
+	// Event offers here. Backends with
+	// richer structured progress (docker's classic/BuildKit paths) report it
+	// through their own package and translate it down to Event for this
+	// interface.
+	EventHandler EventHandler
+}
+
+// Event is a structured notification about build progress, reported at
+// whatever granularity a Backend can manage.
+type Event interface {
+	isBuildEvent()
+}
+
+// OutputLine carries one line of build output.
+type OutputLine struct {
+	Line string
+}
+
+// BuildFailed carries a build failure message.
+type BuildFailed struct {
+	Message string
+}
+
+func (OutputLine) isBuildEvent()  {}
+func (BuildFailed) isBuildEvent() {}
+
+// EventHandler receives Events parsed from a Backend's build output.
+type EventHandler func(Event)
+
+// EventSink wraps dst so that, in addition to everything written to dst, each
+// complete non-empty line written is also reported to handler as an
+// OutputLine.
+// Backends that only have raw build output (as opposed to already-structured
+// messages) use this to support Options.EventHandler without each
+// reimplementing line splitting. Callers must call Flush once the backend is
+// done writing, since a process's last line of output often has no trailing
+// newline and would otherwise never be reported.
+func EventSink(dst io.Writer, handler EventHandler) *Sink {
+	return &Sink{dst: dst, handler: handler}
+}
+
+// Sink is an io.Writer returned by EventSink.
+type Sink struct {
+	dst     io.Writer
+	handler EventHandler
+	pending []byte
+}
+
+func (s *Sink) Write(p []byte) (int, error) {
+	if s.handler != nil {
+		s.pending = append(s.pending, p...)
+		for {
+			i := bytes.IndexByte(s.pending, '\n')
+			if i < 0 {
+				break
+			}
+			if line := strings.TrimRight(string(s.pending[:i]), "\r"); line != "" {
+				s.handler(OutputLine{Line: line})
+			}
+			s.pending = s.pending[i+1:]
+		}
+	}
+	return s.dst.Write(p)
+}
+
+// Flush reports any buffered partial line -- one with no trailing newline --
+// as a final OutputLine.
+func (s *Sink) Flush() {
+	if s.handler == nil || len(s.pending) == 0 {
+		return
+	}
+	if line := strings.TrimRight(string(s.pending), "\r"); line != "" {
+		s.handler(OutputLine{Line: line})
+	}
+	s.pending = nil
+}
+
+// ImageInfo is the backend-agnostic result of Inspect.
+type ImageInfo struct {
+	ID      string
+	Digest  string
+	Created time.Time
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package clibackend implements the build/push/inspect logic shared by every
+// build.Backend that works by shelling out to a docker-workalike CLI tool
+// (podman, buildah). Each such backend supplies a Spec describing the
+// handful of places it differs from the others, and delegates its
+// build.Backend methods to the functions here.
+package clibackend
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/jck/skaffold/pkg/skaffold/build"
+)
+
+// Spec is what distinguishes one docker-workalike CLI tool from another.
+type Spec struct {
+	// Name identifies the tool in wrapped error messages, e.g. "podman".
+	Name string
+	// BuildSubcommand is the subcommand that builds an image, e.g. "build"
+	// for podman or "bud" for buildah.
+	BuildSubcommand string
+	// InspectArgs are the args, before the image ref, of a command that
+	// prints the built image's own ID on stdout.
+	InspectArgs []string
+}
+
+// Build runs `bin <Spec.BuildSubcommand> -t opts.ImageName -f
+// opts.Dockerfile [--target ...] [--build-arg ...] opts.ContextDir`.
+func Build(ctx context.Context, bin string, spec Spec, opts *build.Options) error {
+	args := []string{spec.BuildSubcommand, "-t", opts.ImageName, "-f", opts.Dockerfile}
+	if opts.Target != "" {
+		args = append(args, "--target", opts.Target)
+	}
+	for k, v := range opts.BuildArgs {
+		if v != nil {
+			args = append(args, "--build-arg", k+"="+*v)
+		}
+	}
+	args = append(args, opts.ContextDir)
+
+	cmd := exec.CommandContext(ctx, bin, args...)
+	sink := build.EventSink(opts.BuildBuf, opts.EventHandler)
+	cmd.Stdout = sink
+	cmd.Stderr = opts.ProgressBuf
+	err := cmd.Run()
+	sink.Flush()
+	if err != nil {
+		return errors.Wrapf(err, "%s %s", spec.Name, spec.BuildSubcommand)
+	}
+	return nil
+}
+
+// Push runs `bin push ref`.
+func Push(ctx context.Context, bin string, spec Spec, ref string, out io.Writer) error {
+	cmd := exec.CommandContext(ctx, bin, "push", ref)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "%s push %s", spec.Name, ref)
+	}
+	return nil
+}
+
+// Digest runs `bin <Spec.InspectArgs...> ref` and returns its trimmed stdout.
+func Digest(ctx context.Context, bin string, spec Spec, ref string) (string, error) {
+	args := append(append([]string{}, spec.InspectArgs...), ref)
+	out, err := exec.CommandContext(ctx, bin, args...).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s inspect %s", spec.Name, ref)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Inspect returns ref's ID (from Digest) as both ImageInfo.ID and Digest,
+// since these CLI tools only expose the one identifier.
+func Inspect(ctx context.Context, bin string, spec Spec, ref string) (build.ImageInfo, error) {
+	id, err := Digest(ctx, bin, spec, ref)
+	if err != nil {
+		return build.ImageInfo{}, err
+	}
+	return build.ImageInfo{ID: id, Digest: id}, nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package docker adapts the existing pkg/skaffold/docker helpers to the
+// build.Backend interface, so skaffold can keep talking to the local Docker
+// daemon as one of several interchangeable build backends.
+package docker
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/jck/skaffold/pkg/skaffold/build"
+	"github.com/jck/skaffold/pkg/skaffold/docker"
+)
+
+// Backend drives image builds through a local Docker daemon.
+type Backend struct {
+	cli docker.DockerAPIClient
+}
+
+var _ build.Backend = (*Backend)(nil)
+
+// NewBackend returns a Backend that talks to the daemon through cli.
+func NewBackend(cli docker.DockerAPIClient) *Backend {
+	return &Backend{cli: cli}
+}
+
+func (b *Backend) Build(ctx context.Context, opts *build.Options) error {
+	return docker.RunBuild(ctx, b.cli, &docker.BuildOptions{
+		ImageName:    opts.ImageName,
+		Dockerfile:   opts.Dockerfile,
+		ContextDir:   opts.ContextDir,
+		BuildArgs:    opts.BuildArgs,
+		Target:       opts.Target,
+		ProgressBuf:  opts.ProgressBuf,
+		BuildBuf:     opts.BuildBuf,
+		EventHandler: adaptEventHandler(opts.EventHandler),
+	})
+}
+
+// adaptEventHandler translates docker's richer, step-scoped BuildEvents down
+// to the lowest-common-denominator build.Event every Backend can report.
+// Step start/cache/finish events have no build.Event equivalent and are
+// dropped; output and error events carry through directly.
+func adaptEventHandler(handler build.EventHandler) docker.EventHandler {
+	if handler == nil {
+		return nil
+	}
+	return func(event docker.BuildEvent) {
+		switch e := event.(type) {
+		case docker.StepOutput:
+			handler(build.OutputLine{Line: e.Line})
+		case docker.BuildError:
+			handler(build.BuildFailed{Message: e.Message})
+		}
+	}
+}
+
+func (b *Backend) Push(ctx context.Context, ref string, out io.Writer) error {
+	return docker.RunPush(ctx, b.cli, ref, out)
+}
+
+func (b *Backend) Digest(ctx context.Context, ref string) (string, error) {
+	return docker.Digest(ctx, b.cli, ref)
+}
+
+func (b *Backend) Inspect(ctx context.Context, ref string) (build.ImageInfo, error) {
+	id, err := docker.Digest(ctx, b.cli, ref)
+	if err != nil {
+		return build.ImageInfo{}, errors.Wrapf(err, "inspecting %s", ref)
+	}
+	return build.ImageInfo{ID: id, Digest: id}, nil
+}
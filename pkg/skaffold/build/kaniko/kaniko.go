@@ -0,0 +1,186 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kaniko drives builds by launching an in-cluster kaniko pod, so
+// skaffold can build images daemonlessly straight against a remote registry.
+// kaniko always builds and pushes in the same step and keeps no local image
+// store, so Push is a no-op and Digest and Inspect return an error.
+package kaniko
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/pkg/errors"
+
+	"github.com/jck/skaffold/pkg/skaffold/build"
+)
+
+const kanikoImage = "gcr.io/kaniko-project/executor:latest"
+
+// Backend drives image builds by launching a kaniko executor pod in-cluster.
+type Backend struct {
+	Client    kubernetes.Interface
+	Namespace string
+}
+
+var _ build.Backend = (*Backend)(nil)
+
+// NewBackend returns a Backend that launches kaniko pods in namespace
+// through client.
+func NewBackend(client kubernetes.Interface, namespace string) *Backend {
+	return &Backend{Client: client, Namespace: namespace}
+}
+
+// Build launches a kaniko pod that builds opts.ContextDir and pushes the
+// result to opts.ImageName, then waits for it to complete.
+func (b *Backend) Build(ctx context.Context, opts *build.Options) error {
+	args := []string{
+		fmt.Sprintf("--dockerfile=%s", opts.Dockerfile),
+		fmt.Sprintf("--context=%s", opts.ContextDir),
+		fmt.Sprintf("--destination=%s", opts.ImageName),
+	}
+	if opts.Target != "" {
+		args = append(args, fmt.Sprintf("--target=%s", opts.Target))
+	}
+	for k, v := range opts.BuildArgs {
+		if v != nil {
+			args = append(args, fmt.Sprintf("--build-arg=%s=%s", k, *v))
+		}
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "kaniko-",
+			Namespace:    b.Namespace,
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{{
+				Name:  "kaniko",
+				Image: kanikoImage,
+				Args:  args,
+			}},
+		},
+	}
+
+	created, err := b.Client.CoreV1().Pods(b.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrap(err, "creating kaniko pod")
+	}
+	defer b.Client.CoreV1().Pods(b.Namespace).Delete(ctx, created.Name, metav1.DeleteOptions{})
+
+	if err := waitForPodStarted(ctx, b.Client, b.Namespace, created.Name); err != nil {
+		return errors.Wrap(err, "waiting for kaniko pod to start")
+	}
+
+	sink := build.EventSink(opts.BuildBuf, opts.EventHandler)
+	err = streamPodLogs(ctx, b.Client, b.Namespace, created.Name, sink)
+	sink.Flush()
+	if err != nil {
+		return errors.Wrap(err, "streaming kaniko logs")
+	}
+	return waitForPodSuccess(ctx, b.Client, b.Namespace, created.Name)
+}
+
+// Push is a no-op: kaniko always builds and pushes in the same step.
+func (b *Backend) Push(ctx context.Context, ref string, out io.Writer) error {
+	return nil
+}
+
+// Digest is unsupported locally; kaniko never pulls the image back, so
+// callers should resolve the digest from the registry instead.
+func (b *Backend) Digest(ctx context.Context, ref string) (string, error) {
+	return "", errors.New("kaniko backend does not keep a local image store; resolve the digest from the registry")
+}
+
+func (b *Backend) Inspect(ctx context.Context, ref string) (build.ImageInfo, error) {
+	return build.ImageInfo{}, errors.New("kaniko backend does not keep a local image store; resolve metadata from the registry")
+}
+
+// waitForPodStarted polls until the pod has left Pending, so callers don't
+// ask the apiserver to follow logs for a container that isn't running yet --
+// GetLogs on a pending pod returns a 400 ("container is waiting to start").
+// A pod that goes straight to a terminal phase without ever reading as
+// Running (a very fast build) also satisfies this, since there will be
+// either logs to read or nothing further to wait for.
+func waitForPodStarted(ctx context.Context, client kubernetes.Interface, namespace, name string) error {
+	for {
+		pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pod.Status.Phase != corev1.PodPending {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(podPollInterval):
+		}
+	}
+}
+
+func streamPodLogs(ctx context.Context, client kubernetes.Interface, namespace, name string, out io.Writer) error {
+	req := client.CoreV1().Pods(namespace).GetLogs(name, &corev1.PodLogOptions{Follow: true})
+	rc, err := req.Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(out, rc)
+	return err
+}
+
+// podPollInterval is how often waitForPodStarted and waitForPodSuccess
+// re-check the pod's phase.
+// streamPodLogs following the container to completion usually means the pod
+// is already terminal by the time we get here, but the kubelet can take a
+// moment to flip the phase after the container exits, so we poll rather than
+// trusting a single read.
+const podPollInterval = 2 * time.Second
+
+func waitForPodSuccess(ctx context.Context, client kubernetes.Interface, namespace, name string) error {
+	for {
+		pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		switch pod.Status.Phase {
+		case corev1.PodSucceeded:
+			return nil
+		case corev1.PodFailed:
+			return fmt.Errorf("kaniko pod %s failed: %s", name, pod.Status.Message)
+		case corev1.PodRunning, corev1.PodPending:
+			// Not terminal yet; keep polling.
+		default:
+			return fmt.Errorf("kaniko pod %s ended in unexpected phase %s", name, pod.Status.Phase)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(podPollInterval):
+		}
+	}
+}
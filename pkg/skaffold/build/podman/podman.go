@@ -0,0 +1,69 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package podman drives builds through the podman CLI, for rootless/CI
+// environments that have no Docker daemon to talk to.
+package podman
+
+import (
+	"context"
+	"io"
+
+	"github.com/jck/skaffold/pkg/skaffold/build"
+	"github.com/jck/skaffold/pkg/skaffold/build/clibackend"
+)
+
+var spec = clibackend.Spec{
+	Name:            "podman",
+	BuildSubcommand: "build",
+	InspectArgs:     []string{"image", "inspect", "--format", "{{.Id}}"},
+}
+
+// Backend drives image builds through the `podman` binary on PATH.
+type Backend struct {
+	// Bin overrides the podman binary name/path. Defaults to "podman".
+	Bin string
+}
+
+var _ build.Backend = (*Backend)(nil)
+
+// NewBackend returns a Backend that shells out to podman.
+func NewBackend() *Backend {
+	return &Backend{Bin: "podman"}
+}
+
+func (b *Backend) bin() string {
+	if b.Bin != "" {
+		return b.Bin
+	}
+	return "podman"
+}
+
+func (b *Backend) Build(ctx context.Context, opts *build.Options) error {
+	return clibackend.Build(ctx, b.bin(), spec, opts)
+}
+
+func (b *Backend) Push(ctx context.Context, ref string, out io.Writer) error {
+	return clibackend.Push(ctx, b.bin(), spec, ref, out)
+}
+
+func (b *Backend) Digest(ctx context.Context, ref string) (string, error) {
+	return clibackend.Digest(ctx, b.bin(), spec, ref)
+}
+
+func (b *Backend) Inspect(ctx context.Context, ref string) (build.ImageInfo, error) {
+	return clibackend.Inspect(ctx, b.bin(), spec, ref)
+}
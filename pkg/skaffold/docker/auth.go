@@ -0,0 +1,281 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// dockerConfig is the subset of ~/.docker/config.json that credential
+// resolution cares about.
+type dockerConfig struct {
+	CredsStore  string            `json:"credsStore,omitempty"`
+	CredHelpers map[string]string `json:"credHelpers,omitempty"`
+	Auths       map[string]struct {
+		Auth string `json:"auth,omitempty"`
+	} `json:"auths,omitempty"`
+}
+
+func loadDockerConfig() (*dockerConfig, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting home directory")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(home, ".docker", "config.json"))
+	if os.IsNotExist(err) {
+		return &dockerConfig{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading ~/.docker/config.json")
+	}
+	cfg := &dockerConfig{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, errors.Wrap(err, "parsing ~/.docker/config.json")
+	}
+	return cfg, nil
+}
+
+var (
+	authCacheMu sync.Mutex
+	authCache   = map[string]types.AuthConfig{}
+)
+
+const (
+	// dockerHubRegistry is the hostname go-containerregistry (and the docker
+	// daemon) use for Docker Hub image references.
+	dockerHubRegistry = "index.docker.io"
+	// dockerHubConfigKey is the key the docker CLI has always used for Docker
+	// Hub entries in ~/.docker/config.json's "auths" and "credHelpers" maps,
+	// and the registry value it sends credential helpers for Docker Hub.
+	dockerHubConfigKey = "https://index.docker.io/v1/"
+)
+
+// normalizeRegistryKey maps registry to the key the docker CLI actually uses
+// to look it up in ~/.docker/config.json and to pass to credential helpers.
+// Every registry but Docker Hub uses its own hostname as the key.
+func normalizeRegistryKey(registry string) string {
+	if registry == dockerHubRegistry {
+		return dockerHubConfigKey
+	}
+	return registry
+}
+
+// registryAuthConfig resolves credentials for registry the same way the
+// docker CLI does: a per-registry credHelpers entry wins, falling back to
+// the global credsStore, falling back to a static entry in auths. Results
+// are cached per registry hostname for the life of the process.
+func registryAuthConfig(registry string) (types.AuthConfig, error) {
+	authCacheMu.Lock()
+	if cfg, ok := authCache[registry]; ok {
+		authCacheMu.Unlock()
+		return cfg, nil
+	}
+	authCacheMu.Unlock()
+
+	cfg, err := loadDockerConfig()
+	if err != nil {
+		return types.AuthConfig{}, err
+	}
+
+	key := normalizeRegistryKey(registry)
+	var authConfig types.AuthConfig
+	switch helper := cfg.CredHelpers[key]; {
+	case helper != "":
+		authConfig, err = execCredentialHelper(helper, key)
+	case cfg.CredsStore != "":
+		authConfig, err = execCredentialHelper(cfg.CredsStore, key)
+	default:
+		if entry, ok := cfg.Auths[key]; ok {
+			authConfig, err = decodeStaticAuth(entry.Auth)
+		}
+	}
+	if err != nil {
+		return types.AuthConfig{}, errors.Wrapf(err, "resolving credentials for %s", registry)
+	}
+	authConfig.ServerAddress = registry
+
+	authCacheMu.Lock()
+	authCache[registry] = authConfig
+	authCacheMu.Unlock()
+	return authConfig, nil
+}
+
+// credentialHelperVerb invokes `docker-credential-<helper> <verb>`, writing
+// stdin to the process (when non-empty) and returning its stdout, per the
+// docker-credential-helpers protocol.
+func credentialHelperVerb(helper, verb, stdin string) ([]byte, error) {
+	cmd := exec.Command("docker-credential-"+helper, verb)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "running docker-credential-%s %s", helper, verb)
+	}
+	return stdout.Bytes(), nil
+}
+
+// execCredentialHelper invokes `docker-credential-<helper> get`, writing
+// registry to its stdin and parsing its JSON `{ServerURL,Username,Secret}`
+// response from stdout.
+func execCredentialHelper(helper, registry string) (types.AuthConfig, error) {
+	out, err := credentialHelperVerb(helper, "get", registry)
+	if err != nil {
+		return types.AuthConfig{}, err
+	}
+	var resp struct {
+		ServerURL string
+		Username  string
+		Secret    string
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return types.AuthConfig{}, errors.Wrapf(err, "parsing docker-credential-%s response", helper)
+	}
+	return types.AuthConfig{
+		Username:      resp.Username,
+		Password:      resp.Secret,
+		ServerAddress: resp.ServerURL,
+	}, nil
+}
+
+// storeCredentialHelperAuth persists authConfig for registry via
+// `docker-credential-<helper> store`, the same way `docker login` does, for
+// callers that obtain credentials programmatically (e.g. after an
+// interactive OAuth flow) and want them remembered by the configured helper.
+func storeCredentialHelperAuth(helper, registry string, authConfig types.AuthConfig) error {
+	req := struct {
+		ServerURL string
+		Username  string
+		Secret    string
+	}{
+		ServerURL: normalizeRegistryKey(registry),
+		Username:  authConfig.Username,
+		Secret:    authConfig.Password,
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "encoding credential store request")
+	}
+	_, err = credentialHelperVerb(helper, "store", string(b))
+	return err
+}
+
+// persistRefreshedAuth best-effort persists authConfig as the credentials for
+// registry via its configured credential helper, so a caller-refreshed token
+// (see RunPushWithAuth) is available to future builds/pushes without another
+// refresh. Failures are only logged: this is an optimization, not a
+// correctness requirement, since the caller already has working credentials
+// for the push in hand.
+func persistRefreshedAuth(registry string, authConfig types.AuthConfig) {
+	cfg, err := loadDockerConfig()
+	if err != nil {
+		logrus.Debugf("persisting refreshed credentials for %s: %v", registry, err)
+		return
+	}
+	helper := cfg.CredHelpers[normalizeRegistryKey(registry)]
+	if helper == "" {
+		helper = cfg.CredsStore
+	}
+	if helper == "" {
+		return
+	}
+	if err := storeCredentialHelperAuth(helper, registry, authConfig); err != nil {
+		logrus.Debugf("persisting refreshed credentials for %s: %v", registry, err)
+		return
+	}
+
+	authCacheMu.Lock()
+	authCache[registry] = authConfig
+	authCacheMu.Unlock()
+}
+
+// decodeStaticAuth decodes a base64 `user:pass` entry from the `auths`
+// section of ~/.docker/config.json.
+func decodeStaticAuth(auth string) (types.AuthConfig, error) {
+	if auth == "" {
+		return types.AuthConfig{}, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return types.AuthConfig{}, errors.Wrap(err, "decoding auth entry")
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return types.AuthConfig{}, errors.New("malformed auth entry")
+	}
+	return types.AuthConfig{Username: parts[0], Password: parts[1]}, nil
+}
+
+// resolveAuthConfigs resolves credentials for the registries hosting images,
+// keyed by registry hostname as required by types.ImageBuildOptions.AuthConfigs.
+// Unlike collecting every configured credential, it only contacts credential
+// helpers for registries actually referenced, and never sends unrelated
+// credentials to the daemon.
+func resolveAuthConfigs(images []string) (map[string]types.AuthConfig, error) {
+	out := map[string]types.AuthConfig{}
+	for _, image := range images {
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			logrus.Debugf("parsing image %s for auth resolution: %v", image, err)
+			continue
+		}
+		registry := ref.Context().RegistryStr()
+		if _, ok := out[registry]; ok {
+			continue
+		}
+		authConfig, err := registryAuthConfig(registry)
+		if err != nil {
+			logrus.Debugf("resolving auth for %s: %v", registry, err)
+			continue
+		}
+		out[registry] = authConfig
+	}
+	return out, nil
+}
+
+// authConfigForRef resolves credentials for the single registry hosting ref.
+func authConfigForRef(ref string) (types.AuthConfig, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return types.AuthConfig{}, errors.Wrapf(err, "parsing %s", ref)
+	}
+	return registryAuthConfig(parsed.Context().RegistryStr())
+}
+
+// encodeAuthConfig base64-encodes authConfig the way the docker client does
+// for the X-Registry-Auth header.
+func encodeAuthConfig(authConfig types.AuthConfig) (string, error) {
+	b, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
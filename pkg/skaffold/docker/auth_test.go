@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import "testing"
+
+func TestDecodeStaticAuth(t *testing.T) {
+	tests := []struct {
+		name         string
+		auth         string
+		wantUsername string
+		wantPassword string
+		wantErr      bool
+	}{
+		{
+			name:         "empty",
+			auth:         "",
+			wantUsername: "",
+			wantPassword: "",
+		},
+		{
+			name:         "user and pass",
+			auth:         "dXNlcjpwYXNz", // base64("user:pass")
+			wantUsername: "user",
+			wantPassword: "pass",
+		},
+		{
+			name:    "not base64",
+			auth:    "!!!not-base64!!!",
+			wantErr: true,
+		},
+		{
+			name:    "missing colon",
+			auth:    "dXNlcnBhc3M=", // base64("userpass")
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authConfig, err := decodeStaticAuth(test.auth)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("decodeStaticAuth(%q) = nil error, want an error", test.auth)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeStaticAuth(%q) = %v, want no error", test.auth, err)
+			}
+			if authConfig.Username != test.wantUsername || authConfig.Password != test.wantPassword {
+				t.Errorf("decodeStaticAuth(%q) = %+v, want Username=%q Password=%q",
+					test.auth, authConfig, test.wantUsername, test.wantPassword)
+			}
+		})
+	}
+}
+
+func TestNormalizeRegistryKey(t *testing.T) {
+	tests := []struct {
+		registry string
+		want     string
+	}{
+		{registry: "index.docker.io", want: "https://index.docker.io/v1/"},
+		{registry: "gcr.io", want: "gcr.io"},
+		{registry: "localhost:5000", want: "localhost:5000"},
+	}
+
+	for _, test := range tests {
+		if got := normalizeRegistryKey(test.registry); got != test.want {
+			t.Errorf("normalizeRegistryKey(%q) = %q, want %q", test.registry, got, test.want)
+		}
+	}
+}
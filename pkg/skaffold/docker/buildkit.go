@@ -0,0 +1,240 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/session/sshforward/sshprovider"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// RunBuildKit performs a docker build through the daemon's BuildKit session and
+// frontend APIs, which -- unlike the classic ImageBuild path -- understand
+// `RUN --mount=type=cache/ssh/secret` and other modern Dockerfile syntax.
+//
+// opts.Timestamp is honored the same way RunBuild honors it for the final
+// image Created/history timestamps (via rewriteImageTimestamp), including the
+// SOURCE_DATE_EPOCH build arg. It does not, however, normalize file mtimes
+// the way RunBuild's normalizeTar does: BuildKit syncs the build context
+// straight from disk through LocalDirs rather than through a tar stream we
+// control, so per-layer file timestamps still come from the filesystem.
+func RunBuildKit(ctx context.Context, cli DockerAPIClient, opts *BuildOptions) error {
+	logrus.Debugf("Running buildkit build: context: %s, dockerfile: %s", opts.ContextDir, opts.Dockerfile)
+
+	c, err := client.New(ctx, "", client.WithSessionDialer(func(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error) {
+		return cli.DialHijack(ctx, "/session", proto, meta)
+	}))
+	if err != nil {
+		return errors.Wrap(err, "connecting to buildkit")
+	}
+
+	attachable, err := buildKitSessionAttachables(opts)
+	if err != nil {
+		return errors.Wrap(err, "configuring ssh/secret forwarding")
+	}
+
+	var sourceEpoch *time.Time
+	if opts.Timestamp != "" {
+		ts, err := resolveTimestamp(opts)
+		if err != nil {
+			return errors.Wrap(err, "resolving reproducible timestamp")
+		}
+		sourceEpoch = &ts
+		if opts.BuildArgs == nil {
+			opts.BuildArgs = map[string]*string{}
+		}
+		epoch := strconv.FormatInt(ts.Unix(), 10)
+		opts.BuildArgs["SOURCE_DATE_EPOCH"] = &epoch
+	}
+
+	frontendAttrs := map[string]string{
+		"filename": opts.Dockerfile,
+	}
+	if opts.Target != "" {
+		frontendAttrs["target"] = opts.Target
+	}
+	for k, v := range opts.BuildArgs {
+		if v != nil {
+			frontendAttrs["build-arg:"+k] = *v
+		}
+	}
+
+	solveOpt := client.SolveOpt{
+		Frontend:      "dockerfile.v0",
+		FrontendAttrs: frontendAttrs,
+		Session:       attachable,
+		Exports: []client.ExportEntry{{
+			Type: client.ExporterImage,
+			Attrs: map[string]string{
+				"name": opts.ImageName,
+				"push": "false",
+			},
+		}},
+		LocalDirs: map[string]string{
+			"context":    opts.ContextDir,
+			"dockerfile": opts.ContextDir,
+		},
+		SharedKey: opts.ContextDir,
+	}
+
+	ch := make(chan *client.SolveStatus)
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := c.Solve(ctx, nil, solveOpt, ch)
+		return err
+	})
+	eg.Go(func() error {
+		return streamBuildKitStatus(opts.ProgressBuf, ch, opts.EventHandler)
+	})
+	if err := eg.Wait(); err != nil {
+		return errors.Wrap(err, "buildkit build")
+	}
+
+	if sourceEpoch != nil {
+		if err := rewriteImageTimestamp(ctx, cli, opts.ImageName, *sourceEpoch); err != nil {
+			return errors.Wrap(err, "rewriting image timestamp")
+		}
+	}
+	return nil
+}
+
+// buildKitSessionAttachables wires up registry auth -- so FROM lines can pull
+// from private registries, matching what resolveAuthConfigs does for the
+// classic path -- plus the ssh and secret session attachables requested via
+// opts.SSHAgents and opts.Secrets.
+func buildKitSessionAttachables(opts *BuildOptions) ([]session.Attachable, error) {
+	dockerCfg, err := config.Load(config.Dir())
+	if err != nil {
+		return nil, errors.Wrap(err, "loading docker config for registry auth")
+	}
+	attachable := []session.Attachable{authprovider.NewDockerAuthProvider(dockerCfg)}
+
+	if len(opts.SSHAgents) > 0 {
+		configs := make([]sshprovider.AgentConfig, 0, len(opts.SSHAgents))
+		for _, agent := range opts.SSHAgents {
+			id := agent
+			var paths []string
+			if parts := strings.SplitN(agent, "=", 2); len(parts) == 2 {
+				id, paths = parts[0], []string{parts[1]}
+			}
+			// Paths left nil (bare "default" or "<id>" form, no "=path") tells
+			// the provider to fall back to $SSH_AUTH_SOCK, matching `docker
+			// build --ssh default`. A single empty-string path would instead
+			// make it try to dial a literal "" socket and fail.
+			configs = append(configs, sshprovider.AgentConfig{ID: id, Paths: paths})
+		}
+		sp, err := sshprovider.NewSSHAgentProvider(configs)
+		if err != nil {
+			return nil, errors.Wrap(err, "configuring ssh forwarding")
+		}
+		attachable = append(attachable, sp)
+	}
+
+	if len(opts.Secrets) > 0 {
+		var sources []secretsprovider.Source
+		for _, secret := range opts.Secrets {
+			src := secretsprovider.Source{}
+			for _, kv := range strings.Split(secret, ",") {
+				parts := strings.SplitN(kv, "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				switch parts[0] {
+				case "id":
+					src.ID = parts[1]
+				case "src", "source":
+					src.FilePath = parts[1]
+				case "env":
+					src.Env = parts[1]
+				}
+			}
+			sources = append(sources, src)
+		}
+		store, err := secretsprovider.NewStore(sources)
+		if err != nil {
+			return nil, errors.Wrap(err, "configuring secret forwarding")
+		}
+		attachable = append(attachable, secretsprovider.NewSecretProvider(store))
+	}
+
+	return attachable, nil
+}
+
+// streamBuildKitStatus renders BuildKit's structured vertex/status events
+// (step progress, cache hits) to out, mirroring what streamDockerMessages
+// does for the classic jsonmessage stream, and additionally dispatches them
+// as BuildEvents to handler when handler is non-nil.
+func streamBuildKitStatus(out io.Writer, ch chan *client.SolveStatus, handler EventHandler) error {
+	indices := map[digest.Digest]int{}
+	nextIndex := func(d digest.Digest) int {
+		if i, ok := indices[d]; ok {
+			return i
+		}
+		i := len(indices)
+		indices[d] = i
+		return i
+	}
+
+	for status := range ch {
+		for _, v := range status.Vertexes {
+			index := nextIndex(v.Digest)
+			switch {
+			case v.Cached:
+				fmt.Fprintf(out, "[cached] %s\n", v.Name)
+				if handler != nil {
+					handler(StepCached{Index: index})
+				}
+			case v.Completed != nil:
+				fmt.Fprintf(out, "[done]   %s\n", v.Name)
+				if handler != nil {
+					var dur time.Duration
+					if v.Started != nil {
+						dur = v.Completed.Sub(*v.Started)
+					}
+					handler(StepFinish{Index: index, Duration: dur})
+				}
+			case v.Started != nil:
+				fmt.Fprintf(out, "[start]  %s\n", v.Name)
+				if handler != nil {
+					handler(StepStart{Index: index, Command: v.Name})
+				}
+			}
+		}
+		for _, l := range status.Logs {
+			out.Write(l.Data)
+			if handler != nil {
+				handler(StepOutput{Index: nextIndex(l.Vertex), Line: string(l.Data)})
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// buildCachePath returns the path to skaffold's persistent build cache file,
+// mapping a build's input hash to the imageID/digest it produced.
+func buildCachePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "getting home directory")
+	}
+	return filepath.Join(home, ".skaffold", "build-cache"), nil
+}
+
+func readBuildCache() (map[string]string, error) {
+	path, err := buildCachePath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cache := map[string]string{}
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+func writeBuildCache(cache map[string]string) error {
+	path, err := buildCachePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// lookupBuildCache returns the imageID previously recorded for inputHash, if any.
+func lookupBuildCache(inputHash string) (string, bool) {
+	cache, err := readBuildCache()
+	if err != nil {
+		logrus.Debugf("reading build cache: %v", err)
+		return "", false
+	}
+	imageID, ok := cache[inputHash]
+	return imageID, ok
+}
+
+// recordBuildCache persists the mapping inputHash -> imageID.
+func recordBuildCache(inputHash, imageID string) error {
+	cache, err := readBuildCache()
+	if err != nil {
+		cache = map[string]string{}
+	}
+	cache[inputHash] = imageID
+	return writeBuildCache(cache)
+}
+
+// inputHashForImageID reverse-looks-up the cached input hash for imageID, or
+// "" if imageID was never recorded by the build cache.
+func inputHashForImageID(imageID string) string {
+	cache, err := readBuildCache()
+	if err != nil {
+		return ""
+	}
+	for hash, id := range cache {
+		if id == imageID {
+			return hash
+		}
+	}
+	return ""
+}
+
+// hashBuildInputs computes a stable hash over everything that determines a
+// build's output: the Dockerfile bytes, the target stage, the context
+// directory, the content/mode/path of every file GetDockerfileDependencies
+// reports, the resolved build args, and the registry digests of any base
+// images referenced by FROM lines. Two builds with the same hash are
+// expected to produce the same image, so the caller can skip the daemon
+// build entirely on a cache hit.
+func hashBuildInputs(ctx context.Context, dockerfileBytes []byte, target, contextDir string, depPaths []string, buildArgs map[string]*string) (string, error) {
+	h := sha256.New()
+	h.Write(dockerfileBytes)
+	fmt.Fprintf(h, "target:%s\n", target)
+	fmt.Fprintf(h, "context:%s\n", contextDir)
+
+	sorted := append([]string(nil), depPaths...)
+	sort.Strings(sorted)
+	for _, path := range sorted {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", errors.Wrapf(err, "stat %s", path)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.Wrapf(err, "reading %s", path)
+		}
+		sum := sha256.Sum256(b)
+		fmt.Fprintf(h, "file:%s:%o:%x\n", path, info.Mode(), sum)
+	}
+
+	argKeys := make([]string, 0, len(buildArgs))
+	for k := range buildArgs {
+		argKeys = append(argKeys, k)
+	}
+	sort.Strings(argKeys)
+	for _, k := range argKeys {
+		if v := buildArgs[k]; v != nil {
+			fmt.Fprintf(h, "arg:%s=%s\n", k, *v)
+		}
+	}
+
+	for _, base := range baseImageDigests(ctx, dockerfileBytes) {
+		fmt.Fprintf(h, "base:%s\n", base)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fromImages returns the image reference on every FROM line of dockerfile,
+// skipping the `scratch` pseudo-image.
+func fromImages(dockerfile []byte) []string {
+	var images []string
+	for _, line := range strings.Split(string(dockerfile), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		image := fields[1]
+		if strings.EqualFold(image, "scratch") {
+			continue
+		}
+		images = append(images, image)
+	}
+	return images
+}
+
+// baseImageCachePath returns the path to skaffold's persistent cache of
+// resolved base-image digests, keyed by FROM-line image reference.
+func baseImageCachePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "getting home directory")
+	}
+	return filepath.Join(home, ".skaffold", "base-image-cache"), nil
+}
+
+var (
+	baseImageCacheMu sync.Mutex
+	baseImageCache   map[string]string // image ref -> last resolved digest
+)
+
+// loadBaseImageCache lazily loads the persistent base-image digest cache into
+// memory, so repeated builds in the same process only read it once.
+func loadBaseImageCache() map[string]string {
+	baseImageCacheMu.Lock()
+	defer baseImageCacheMu.Unlock()
+	if baseImageCache != nil {
+		return baseImageCache
+	}
+	baseImageCache = map[string]string{}
+	path, err := baseImageCachePath()
+	if err != nil {
+		return baseImageCache
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return baseImageCache
+	}
+	json.Unmarshal(b, &baseImageCache)
+	return baseImageCache
+}
+
+// recordBaseImageDigest persists the resolved digest for image so later
+// builds -- including offline ones -- can reuse it as a cache key without a
+// registry round-trip.
+func recordBaseImageDigest(image, digest string) {
+	baseImageCacheMu.Lock()
+	defer baseImageCacheMu.Unlock()
+	if baseImageCache == nil {
+		baseImageCache = map[string]string{}
+	}
+	baseImageCache[image] = digest
+
+	path, err := baseImageCachePath()
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		logrus.Debugf("creating base image cache directory: %v", err)
+		return
+	}
+	b, err := json.Marshal(baseImageCache)
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		logrus.Debugf("writing base image cache: %v", err)
+	}
+}
+
+// baseImageDigests resolves every FROM line in dockerfile to a registry
+// digest. Every call asks the registry first; resolved digests are cached on
+// disk, and if the registry is unreachable (offline build) the last known
+// digest is used instead of being silently dropped, so the same Dockerfile
+// hashes the same way online or off.
+// Images that have never resolved and can't be reached now fall back to
+// relying on the Dockerfile/dependency hashes alone.
+func baseImageDigests(ctx context.Context, dockerfile []byte) []string {
+	cache := loadBaseImageCache()
+	var digests []string
+	for _, image := range fromImages(dockerfile) {
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			logrus.Debugf("parsing base image %s: %v", image, err)
+			continue
+		}
+		desc, err := remote.Head(ref, remote.WithContext(ctx))
+		if err != nil {
+			if cached, ok := cache[image]; ok {
+				logrus.Debugf("resolving digest for base image %s: %v; using last known digest", image, err)
+				digests = append(digests, image+"@"+cached)
+				continue
+			}
+			logrus.Debugf("resolving digest for base image %s: %v", image, err)
+			continue
+		}
+		recordBaseImageDigest(image, desc.Digest.String())
+		digests = append(digests, image+"@"+desc.Digest.String())
+	}
+	return digests
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFromImages(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		want       []string
+	}{
+		{
+			name:       "single stage",
+			dockerfile: "FROM golang:1.12\nRUN go build ./...\n",
+			want:       []string{"golang:1.12"},
+		},
+		{
+			name:       "multi stage",
+			dockerfile: "FROM golang:1.12 AS build\nRUN go build ./...\nFROM gcr.io/distroless/base\nCOPY --from=build /app /app\n",
+			want:       []string{"golang:1.12", "gcr.io/distroless/base"},
+		},
+		{
+			name:       "scratch is skipped",
+			dockerfile: "FROM scratch\nCOPY app /app\n",
+			want:       nil,
+		},
+		{
+			name:       "lowercase from",
+			dockerfile: "from alpine\n",
+			want:       []string{"alpine"},
+		},
+		{
+			name:       "empty",
+			dockerfile: "",
+			want:       nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := fromImages([]byte(test.dockerfile))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("fromImages(%q) = %v, want %v", test.dockerfile, got, test.want)
+			}
+		})
+	}
+}
+
+func TestHashBuildInputsStableForSameInputs(t *testing.T) {
+	dir := t.TempDir()
+	depPath := filepath.Join(dir, "main.go")
+	if err := ioutil.WriteFile(depPath, []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dockerfile := []byte("FROM scratch\nCOPY main.go /main.go\n")
+	args := map[string]*string{"FOO": strPtr("bar")}
+
+	h1, err := hashBuildInputs(context.Background(), dockerfile, "", dir, []string{depPath}, args)
+	if err != nil {
+		t.Fatalf("hashBuildInputs: %v", err)
+	}
+	h2, err := hashBuildInputs(context.Background(), dockerfile, "", dir, []string{depPath}, args)
+	if err != nil {
+		t.Fatalf("hashBuildInputs: %v", err)
+	}
+	if h1 != h2 {
+		t.Errorf("hashBuildInputs is not stable for identical inputs: %q != %q", h1, h2)
+	}
+}
+
+func TestHashBuildInputsChangesWithDependencyContent(t *testing.T) {
+	dir := t.TempDir()
+	depPath := filepath.Join(dir, "main.go")
+	dockerfile := []byte("FROM scratch\nCOPY main.go /main.go\n")
+
+	if err := ioutil.WriteFile(depPath, []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := hashBuildInputs(context.Background(), dockerfile, "", dir, []string{depPath}, nil)
+	if err != nil {
+		t.Fatalf("hashBuildInputs: %v", err)
+	}
+
+	if err := ioutil.WriteFile(depPath, []byte("package main\n// changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	after, err := hashBuildInputs(context.Background(), dockerfile, "", dir, []string{depPath}, nil)
+	if err != nil {
+		t.Fatalf("hashBuildInputs: %v", err)
+	}
+
+	if before == after {
+		t.Errorf("hashBuildInputs did not change when dependency content changed")
+	}
+}
+
+func TestHashBuildInputsChangesWithBuildArgs(t *testing.T) {
+	dockerfile := []byte("FROM scratch\n")
+
+	h1, err := hashBuildInputs(context.Background(), dockerfile, "", "", nil, map[string]*string{"FOO": strPtr("1")})
+	if err != nil {
+		t.Fatalf("hashBuildInputs: %v", err)
+	}
+	h2, err := hashBuildInputs(context.Background(), dockerfile, "", "", nil, map[string]*string{"FOO": strPtr("2")})
+	if err != nil {
+		t.Fatalf("hashBuildInputs: %v", err)
+	}
+	if h1 == h2 {
+		t.Errorf("hashBuildInputs did not change when a build arg value changed")
+	}
+}
+
+func TestHashBuildInputsChangesWithTarget(t *testing.T) {
+	dockerfile := []byte("FROM golang:1.12 AS build\nFROM scratch\n")
+
+	h1, err := hashBuildInputs(context.Background(), dockerfile, "build", "", nil, nil)
+	if err != nil {
+		t.Fatalf("hashBuildInputs: %v", err)
+	}
+	h2, err := hashBuildInputs(context.Background(), dockerfile, "final", "", nil, nil)
+	if err != nil {
+		t.Fatalf("hashBuildInputs: %v", err)
+	}
+	if h1 == h2 {
+		t.Errorf("hashBuildInputs did not change when Target changed")
+	}
+}
+
+func strPtr(s string) *string { return &s }
+
+func TestBaseImageCachePath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skipf("no home directory: %v", err)
+	}
+	path, err := baseImageCachePath()
+	if err != nil {
+		t.Fatalf("baseImageCachePath: %v", err)
+	}
+	want := filepath.Join(home, ".skaffold", "base-image-cache")
+	if path != want {
+		t.Errorf("baseImageCachePath() = %q, want %q", path, want)
+	}
+}
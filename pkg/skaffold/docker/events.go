@@ -0,0 +1,210 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moby/moby/pkg/jsonmessage"
+)
+
+// BuildEvent is a structured notification about build progress, parsed from
+// the daemon's jsonmessage stream. It lets callers show per-step timing and
+// cache hits, or report machine-readable errors, without regex-scraping
+// docker's human-oriented stdout.
+type BuildEvent interface {
+	isBuildEvent()
+}
+
+// ContextUploadProgress reports progress sending the build context to the daemon.
+type ContextUploadProgress struct {
+	Bytes, Total int64
+}
+
+// StepStart marks the beginning of a Dockerfile instruction.
+type StepStart struct {
+	Index, Total int
+	Command      string
+}
+
+// StepOutput carries a line of a step's build output.
+type StepOutput struct {
+	Index int
+	Line  string
+}
+
+// StepCached marks that a step was served from the daemon's build cache.
+type StepCached struct {
+	Index int
+}
+
+// StepFinish marks the end of a Dockerfile instruction.
+type StepFinish struct {
+	Index    int
+	Duration time.Duration
+}
+
+// ImageID reports the digest of the built image.
+type ImageID struct {
+	Digest string
+}
+
+// BuildError carries a build failure, scoped to the step it occurred in when known.
+type BuildError struct {
+	Step    int
+	Message string
+}
+
+func (ContextUploadProgress) isBuildEvent() {}
+func (StepStart) isBuildEvent()             {}
+func (StepOutput) isBuildEvent()            {}
+func (StepCached) isBuildEvent()            {}
+func (StepFinish) isBuildEvent()            {}
+func (ImageID) isBuildEvent()               {}
+func (BuildError) isBuildEvent()            {}
+
+// EventHandler receives BuildEvents parsed from the daemon's build output.
+type EventHandler func(BuildEvent)
+
+// streamBuildEvents renders the daemon's jsonmessage stream from src the same
+// way streamDockerMessages does, and additionally parses it into BuildEvents
+// dispatched to handler when handler is non-nil.
+func streamBuildEvents(dst io.Writer, src io.Reader, handler EventHandler) error {
+	if handler == nil {
+		return streamDockerMessages(dst, src)
+	}
+
+	pr, pw := io.Pipe()
+	tee := io.TeeReader(src, pw)
+	done := make(chan error, 1)
+	go func() {
+		done <- streamDockerMessages(dst, tee)
+		pw.Close()
+	}()
+
+	decodeErr := decodeBuildEvents(pr, handler)
+	// decodeBuildEvents can return before the stream is exhausted (e.g. on a
+	// malformed message). Close pr so a pw.Write blocked in the goroutine
+	// above unblocks with an error instead of leaking forever waiting for a
+	// reader that's gone.
+	pr.Close()
+	if err := <-done; err != nil {
+		return err
+	}
+	return decodeErr
+}
+
+// stepTracker remembers the currently open Dockerfile instruction so output
+// lines and cache hits can be attributed to it, and so its StepFinish can
+// carry a duration.
+type stepTracker struct {
+	index int
+	start time.Time
+	open  bool
+}
+
+// decodeBuildEvents turns a jsonmessage stream into BuildEvents. Note that
+// resp.Body (the stream this reads) never carries a "Sending build context"
+// message -- that one is written to opts.ProgressBuf instead, and is turned
+// into ContextUploadProgress events by progressEventWriter.
+func decodeBuildEvents(src io.Reader, handler EventHandler) error {
+	var step stepTracker
+	finishStep := func() {
+		if step.open {
+			handler(StepFinish{Index: step.index, Duration: time.Since(step.start)})
+			step.open = false
+		}
+	}
+
+	dec := json.NewDecoder(src)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			finishStep()
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if msg.Error != nil {
+			handler(BuildError{Step: step.index, Message: msg.Error.Message})
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(msg.Stream, "Step "):
+			finishStep()
+			index, total, command := parseStepHeader(msg.Stream)
+			step = stepTracker{index, time.Now(), true}
+			handler(StepStart{Index: index, Total: total, Command: command})
+
+		case strings.Contains(msg.Stream, "Using cache"):
+			handler(StepCached{Index: step.index})
+
+		case strings.HasPrefix(msg.Stream, "Successfully built "):
+			finishStep()
+			handler(ImageID{Digest: strings.TrimSpace(strings.TrimPrefix(msg.Stream, "Successfully built "))})
+
+		case strings.TrimSpace(msg.Stream) != "":
+			handler(StepOutput{Index: step.index, Line: strings.TrimRight(msg.Stream, "\n")})
+		}
+	}
+}
+
+// progressEventWriter wraps the writer docker's streamformatter renders
+// context-upload progress into, additionally decoding each message it
+// carries into a ContextUploadProgress event. This is the only place that
+// message shows up -- it never appears in the daemon's build response, the
+// stream decodeBuildEvents reads.
+type progressEventWriter struct {
+	dst     io.Writer
+	handler EventHandler
+}
+
+func (w *progressEventWriter) Write(p []byte) (int, error) {
+	dec := json.NewDecoder(bytes.NewReader(p))
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			break
+		}
+		if msg.Progress != nil && strings.Contains(msg.Status, "Sending build context") {
+			w.handler(ContextUploadProgress{Bytes: msg.Progress.Current, Total: msg.Progress.Total})
+		}
+	}
+	return w.dst.Write(p)
+}
+
+// parseStepHeader parses a line like "Step 2/5 : RUN make build" into its
+// index, total step count, and command.
+func parseStepHeader(line string) (index, total int, command string) {
+	line = strings.TrimPrefix(line, "Step ")
+	parts := strings.SplitN(line, " : ", 2)
+	if len(parts) == 2 {
+		command = strings.TrimSpace(parts[1])
+	}
+	if nums := strings.SplitN(parts[0], "/", 2); len(nums) == 2 {
+		index, _ = strconv.Atoi(strings.TrimSpace(nums[0]))
+		total, _ = strconv.Atoi(strings.TrimSpace(nums[1]))
+	}
+	return index, total, command
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import "testing"
+
+func TestParseStepHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		wantIndex   int
+		wantTotal   int
+		wantCommand string
+	}{
+		{
+			name:        "simple",
+			line:        "Step 2/5 : RUN make build",
+			wantIndex:   2,
+			wantTotal:   5,
+			wantCommand: "RUN make build",
+		},
+		{
+			name:        "no command",
+			line:        "Step 1/1",
+			wantIndex:   1,
+			wantTotal:   1,
+			wantCommand: "",
+		},
+		{
+			name:        "extra whitespace",
+			line:        "Step  3/4  :  COPY . /app",
+			wantIndex:   3,
+			wantTotal:   4,
+			wantCommand: "COPY . /app",
+		},
+		{
+			name:        "malformed",
+			line:        "Step weird",
+			wantIndex:   0,
+			wantTotal:   0,
+			wantCommand: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index, total, command := parseStepHeader(test.line)
+			if index != test.wantIndex || total != test.wantTotal || command != test.wantCommand {
+				t.Errorf("parseStepHeader(%q) = (%d, %d, %q), want (%d, %d, %q)",
+					test.line, index, total, command, test.wantIndex, test.wantTotal, test.wantCommand)
+			}
+		})
+	}
+}
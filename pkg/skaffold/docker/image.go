@@ -20,14 +20,18 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/pkg/idtools"
 	"github.com/docker/docker/pkg/progress"
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/moby/moby/pkg/archive"
 	"github.com/moby/moby/pkg/jsonmessage"
 	"github.com/moby/moby/pkg/streamformatter"
@@ -36,6 +40,16 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// Builder selects which API skaffold uses to build the image.
+type Builder string
+
+const (
+	// BuilderClassic drives the daemon's legacy ImageBuild API.
+	BuilderClassic Builder = "classic"
+	// BuilderBuildKit drives the daemon through the BuildKit session/frontend APIs.
+	BuilderBuildKit Builder = "buildkit"
+)
+
 type BuildOptions struct {
 	ImageName   string
 	Dockerfile  string
@@ -43,14 +57,59 @@ type BuildOptions struct {
 	ProgressBuf io.Writer
 	BuildBuf    io.Writer
 	BuildArgs   map[string]*string
+
+	// Builder selects the build backend. Defaults to BuilderClassic when empty.
+	Builder Builder
+	// Target is the Dockerfile stage to build, for multi-stage Dockerfiles.
+	Target string
+	// SSHAgents lists `--ssh` forwards, each in `default` or `<id>=<path>` form.
+	// Only honored by BuilderBuildKit.
+	SSHAgents []string
+	// Secrets lists `--secret` mounts, each in `id=<id>,src=<path>` or `id=<id>,env=<name>` form.
+	// Only honored by BuilderBuildKit.
+	Secrets []string
+
+	// Timestamp requests a reproducible build. It is either TimestampZero,
+	// TimestampSourceTimestamp, or an explicit RFC3339 value. Empty means the
+	// build is not made reproducible.
+	Timestamp string
+
+	// EventHandler, if set, receives structured BuildEvents parsed from the
+	// daemon's build output in addition to the human-readable output written
+	// to BuildBuf.
+	EventHandler EventHandler
 }
 
 // RunBuild performs a docker build and returns nothing
 func RunBuild(ctx context.Context, cli DockerAPIClient, opts *BuildOptions) error {
+	if opts.Builder == BuilderBuildKit {
+		return RunBuildKit(ctx, cli, opts)
+	}
+
 	logrus.Debugf("Running docker build: context: %s, dockerfile: %s", opts.ContextDir, opts.Dockerfile)
-	authConfigs, err := DefaultAuthHelper.GetAllAuthConfigs()
+	dockerfilePath := filepath.Join(opts.ContextDir, opts.Dockerfile)
+	dockerfileBytes, err := ioutil.ReadFile(dockerfilePath)
+	if err != nil {
+		return errors.Wrap(err, "reading dockerfile")
+	}
+
+	authConfigs, err := resolveAuthConfigs(fromImages(dockerfileBytes))
 	if err != nil {
-		return errors.Wrap(err, "read auth configs")
+		return errors.Wrap(err, "resolving registry auth")
+	}
+
+	var sourceEpoch *time.Time
+	if opts.Timestamp != "" {
+		ts, err := resolveTimestamp(opts)
+		if err != nil {
+			return errors.Wrap(err, "resolving reproducible timestamp")
+		}
+		sourceEpoch = &ts
+		if opts.BuildArgs == nil {
+			opts.BuildArgs = map[string]*string{}
+		}
+		epoch := strconv.FormatInt(ts.Unix(), 10)
+		opts.BuildArgs["SOURCE_DATE_EPOCH"] = &epoch
 	}
 
 	imageBuildOpts := types.ImageBuildOptions{
@@ -58,14 +117,26 @@ func RunBuild(ctx context.Context, cli DockerAPIClient, opts *BuildOptions) erro
 		Dockerfile:  opts.Dockerfile,
 		BuildArgs:   opts.BuildArgs,
 		AuthConfigs: authConfigs,
+		Target:      opts.Target,
 	}
 
-	dockerfilePath := filepath.Join(opts.ContextDir, opts.Dockerfile)
 	f, err := os.Open(dockerfilePath)
 	if err != nil {
 		return errors.Wrap(err, "opening dockerfile")
 	}
 	paths, err := GetDockerfileDependencies(opts.ContextDir, f)
+
+	inputHash, hashErr := hashBuildInputs(ctx, dockerfileBytes, opts.Target, opts.ContextDir, paths, opts.BuildArgs)
+	if hashErr != nil {
+		logrus.Debugf("computing build cache key for %s: %v", opts.ImageName, hashErr)
+	} else if cachedImageID, ok := lookupBuildCache(inputHash); ok {
+		if err := cli.ImageTag(ctx, cachedImageID, opts.ImageName); err == nil {
+			logrus.Debugf("build cache hit for %s: reusing %s", opts.ImageName, cachedImageID)
+			return nil
+		}
+		logrus.Debugf("build cache entry for %s (%s) is stale, rebuilding", opts.ImageName, cachedImageID)
+	}
+
 	for i, path := range paths {
 		paths[i] = strings.TrimPrefix(path, opts.ContextDir)
 	}
@@ -76,8 +147,15 @@ func RunBuild(ctx context.Context, cli DockerAPIClient, opts *BuildOptions) erro
 	if err != nil {
 		return errors.Wrap(err, "tar workspace")
 	}
+	if sourceEpoch != nil {
+		buildCtx = normalizeTar(buildCtx, *sourceEpoch)
+	}
 
-	progressOutput := streamformatter.NewProgressOutput(opts.ProgressBuf)
+	progressDst := opts.ProgressBuf
+	if opts.EventHandler != nil {
+		progressDst = &progressEventWriter{dst: opts.ProgressBuf, handler: opts.EventHandler}
+	}
+	progressOutput := streamformatter.NewProgressOutput(progressDst)
 	body := progress.NewProgressReader(buildCtx, progressOutput, 0, "", "Sending build context to Docker daemon")
 
 	resp, err := cli.ImageBuild(ctx, body, imageBuildOpts)
@@ -85,7 +163,24 @@ func RunBuild(ctx context.Context, cli DockerAPIClient, opts *BuildOptions) erro
 		return errors.Wrap(err, "docker build")
 	}
 	defer resp.Body.Close()
-	return streamDockerMessages(opts.BuildBuf, resp.Body)
+	if err := streamBuildEvents(opts.BuildBuf, resp.Body, opts.EventHandler); err != nil {
+		return err
+	}
+
+	if sourceEpoch != nil {
+		if err := rewriteImageTimestamp(ctx, cli, opts.ImageName, *sourceEpoch); err != nil {
+			return errors.Wrap(err, "rewriting image timestamp")
+		}
+	}
+
+	if hashErr == nil {
+		if imageID, err := Digest(ctx, cli, opts.ImageName); err == nil && imageID != "" {
+			if err := recordBuildCache(inputHash, imageID); err != nil {
+				logrus.Debugf("recording build cache entry for %s: %v", opts.ImageName, err)
+			}
+		}
+	}
+	return nil
 }
 
 // TODO(@r2d4): Make this output much better, this is the bare minimum
@@ -95,10 +190,22 @@ func streamDockerMessages(dst io.Writer, src io.Reader) error {
 }
 
 func RunPush(ctx context.Context, cli DockerAPIClient, ref string, out io.Writer) error {
-	registryAuth, err := encodedRegistryAuth(ctx, cli, DefaultAuthHelper, ref)
+	authConfig, err := authConfigForRef(ref)
 	if err != nil {
 		return errors.Wrapf(err, "getting auth config for %s", ref)
 	}
+	return RunPushWithAuth(ctx, cli, ref, authConfig, out)
+}
+
+// RunPushWithAuth pushes ref using authOverride instead of resolving
+// credentials from ~/.docker/config.json, for callers that already hold
+// programmatically-obtained credentials (e.g. a freshly refreshed ECR/GCR
+// token).
+func RunPushWithAuth(ctx context.Context, cli DockerAPIClient, ref string, authOverride types.AuthConfig, out io.Writer) error {
+	registryAuth, err := encodeAuthConfig(authOverride)
+	if err != nil {
+		return errors.Wrapf(err, "encoding auth config for %s", ref)
+	}
 	rc, err := cli.ImagePush(ctx, ref, types.ImagePushOptions{
 		RegistryAuth: registryAuth,
 	})
@@ -106,15 +213,22 @@ func RunPush(ctx context.Context, cli DockerAPIClient, ref string, out io.Writer
 		return errors.Wrap(err, "pushing image to repository")
 	}
 	defer rc.Close()
-	return streamDockerMessages(out, rc)
+	if err := streamDockerMessages(out, rc); err != nil {
+		return err
+	}
+
+	if parsed, err := name.ParseReference(ref); err == nil {
+		persistRefreshedAuth(parsed.Context().RegistryStr(), authOverride)
+	}
+	return nil
 }
 
 // Digest returns the image digest for a corresponding reference.
 // The digest is of the form
 // sha256:<image_id>
 func Digest(ctx context.Context, cli DockerAPIClient, ref string) (string, error) {
-	refLatest := fmt.Sprintf("%s:latest", ref)
-	args := filters.KeyValuePair{Key: "reference", Value: refLatest}
+	taggedRef := withDefaultTag(ref)
+	args := filters.KeyValuePair{Key: "reference", Value: taggedRef}
 	filters := filters.NewArgs(args)
 	imageList, err := cli.ImageList(ctx, types.ImageListOptions{
 		Filters: filters,
@@ -124,10 +238,40 @@ func Digest(ctx context.Context, cli DockerAPIClient, ref string) (string, error
 	}
 	for _, image := range imageList {
 		for _, tag := range image.RepoTags {
-			if tag == refLatest {
+			if tag == taggedRef {
 				return image.ID, nil
 			}
 		}
 	}
 	return "", nil
 }
+
+// withDefaultTag returns ref unchanged if it already carries a tag or
+// digest, and appends ":latest" otherwise -- mirroring how the docker CLI
+// resolves an untagged reference.
+func withDefaultTag(ref string) string {
+	// A ':' after the last '/' is a tag (or "@sha256:..." digest); a ':' that
+	// only appears as part of a host:port prefix doesn't count.
+	if idx := strings.LastIndex(ref, ":"); idx > strings.LastIndex(ref, "/") {
+		return ref
+	}
+	return ref + ":latest"
+}
+
+// ImageDigest pairs the classic docker image ID with the build-cache input
+// hash that produced it, so downstream deploy stages can key off of either.
+type ImageDigest struct {
+	ImageID   string
+	InputHash string
+}
+
+// DigestWithInputHash returns ref's image ID along with the build cache's
+// recorded input hash for it, if any. InputHash is empty when ref was never
+// built through the cache (e.g. it was pulled, not built).
+func DigestWithInputHash(ctx context.Context, cli DockerAPIClient, ref string) (ImageDigest, error) {
+	imageID, err := Digest(ctx, cli, ref)
+	if err != nil {
+		return ImageDigest{}, err
+	}
+	return ImageDigest{ImageID: imageID, InputHash: inputHashForImageID(imageID)}, nil
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import "testing"
+
+func TestWithDefaultTag(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{ref: "busybox", want: "busybox:latest"},
+		{ref: "busybox:1.2", want: "busybox:1.2"},
+		{ref: "gcr.io/project/image", want: "gcr.io/project/image:latest"},
+		{ref: "gcr.io/project/image:v1", want: "gcr.io/project/image:v1"},
+		{ref: "localhost:5000/image", want: "localhost:5000/image:latest"},
+		{ref: "localhost:5000/image:v1", want: "localhost:5000/image:v1"},
+		{ref: "busybox@sha256:abcd", want: "busybox@sha256:abcd"},
+	}
+
+	for _, test := range tests {
+		if got := withDefaultTag(test.ref); got != test.want {
+			t.Errorf("withDefaultTag(%q) = %q, want %q", test.ref, got, test.want)
+		}
+	}
+}
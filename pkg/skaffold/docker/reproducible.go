@@ -0,0 +1,270 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// TimestampZero pins the image's Created time and every layer history
+	// timestamp to the Unix epoch.
+	TimestampZero = "zero"
+	// TimestampSourceTimestamp derives the timestamp from the HEAD commit
+	// time if ContextDir is a git checkout, or else from the newest mtime of
+	// any file under ContextDir, including files not sent in the build
+	// context.
+	TimestampSourceTimestamp = "source"
+)
+
+// resolveTimestamp turns opts.Timestamp into a concrete point in time.
+func resolveTimestamp(opts *BuildOptions) (time.Time, error) {
+	switch opts.Timestamp {
+	case TimestampZero:
+		return time.Unix(0, 0).UTC(), nil
+	case TimestampSourceTimestamp:
+		return sourceTimestamp(opts.ContextDir)
+	default:
+		return time.Parse(time.RFC3339, opts.Timestamp)
+	}
+}
+
+// sourceTimestamp returns the git HEAD commit time for contextDir if it is
+// part of a git checkout, falling back to the newest file mtime under it.
+func sourceTimestamp(contextDir string) (time.Time, error) {
+	out, err := exec.Command("git", "-C", contextDir, "log", "-1", "--format=%cI").Output()
+	if err == nil {
+		if ts, err := time.Parse(time.RFC3339, strings.TrimSpace(string(out))); err == nil {
+			return ts, nil
+		}
+	}
+
+	var newest time.Time
+	err = filepath.Walk(contextDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "walking context dir for newest mtime")
+	}
+	return newest.UTC(), nil
+}
+
+// normalizeTar rewrites every header in the tar stream produced by
+// archive.TarWithOptions so that mtime, uid and gid are pinned to ts and 0/0
+// respectively. archive.TarWithOptions only lets us pin ownership via
+// ChownOpts; file mtimes still come from the filesystem, which would
+// otherwise make repeated builds on unchanged inputs produce different
+// layer digests.
+func normalizeTar(src io.ReadCloser, ts time.Time) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tr := tar.NewReader(src)
+		tw := tar.NewWriter(pw)
+		err := func() error {
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				hdr.ModTime = ts
+				hdr.AccessTime = ts
+				hdr.ChangeTime = ts
+				hdr.Uid, hdr.Gid = 0, 0
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+				if _, err := io.Copy(tw, tr); err != nil {
+					return err
+				}
+			}
+		}()
+		if err == nil {
+			err = tw.Close()
+		}
+		src.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// rewriteImageTimestamp pins ref's config Created field and every layer
+// history timestamp to ts, by exporting the image, mutating its JSON, and
+// re-importing it under the same tag.
+func rewriteImageTimestamp(ctx context.Context, cli DockerAPIClient, ref string, ts time.Time) error {
+	saved, err := cli.ImageSave(ctx, []string{ref})
+	if err != nil {
+		return errors.Wrap(err, "exporting image")
+	}
+	defer saved.Close()
+
+	tmp, err := ioutil.TempDir("", "skaffold-reproducible")
+	if err != nil {
+		return errors.Wrap(err, "creating temp dir")
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := untar(saved, tmp); err != nil {
+		return errors.Wrap(err, "unpacking image")
+	}
+
+	manifestPath := filepath.Join(tmp, "manifest.json")
+	var manifests []struct {
+		Config string
+		Layers []string
+	}
+	if err := readJSON(manifestPath, &manifests); err != nil {
+		return errors.Wrap(err, "reading manifest.json")
+	}
+
+	for _, m := range manifests {
+		configPath := filepath.Join(tmp, m.Config)
+		var config map[string]interface{}
+		if err := readJSON(configPath, &config); err != nil {
+			return errors.Wrap(err, "reading image config")
+		}
+
+		config["created"] = ts.Format(time.RFC3339Nano)
+		if history, ok := config["history"].([]interface{}); ok {
+			for _, h := range history {
+				if entry, ok := h.(map[string]interface{}); ok {
+					entry["created"] = ts.Format(time.RFC3339Nano)
+				}
+			}
+		}
+		if err := writeJSON(configPath, config); err != nil {
+			return errors.Wrap(err, "writing image config")
+		}
+	}
+
+	retarred, err := tarDir(tmp)
+	if err != nil {
+		return errors.Wrap(err, "repacking image")
+	}
+	resp, err := cli.ImageLoad(ctx, retarred, false)
+	if err != nil {
+		return errors.Wrap(err, "re-importing image")
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+func readJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func writeJSON(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+func untar(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		default:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			f.Close()
+		}
+	}
+}
+
+func tarDir(dir string) (io.Reader, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestResolveTimestamp(t *testing.T) {
+	tests := []struct {
+		name      string
+		timestamp string
+		want      time.Time
+		wantErr   bool
+	}{
+		{
+			name:      "zero",
+			timestamp: TimestampZero,
+			want:      time.Unix(0, 0).UTC(),
+		},
+		{
+			name:      "explicit RFC3339",
+			timestamp: "2020-01-02T15:04:05Z",
+			want:      time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC),
+		},
+		{
+			name:      "malformed",
+			timestamp: "not-a-timestamp",
+			wantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolveTimestamp(&BuildOptions{Timestamp: test.timestamp})
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("resolveTimestamp(%q) = nil error, want an error", test.timestamp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveTimestamp(%q) = %v, want no error", test.timestamp, err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("resolveTimestamp(%q) = %v, want %v", test.timestamp, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	contents := "hello world"
+	if err := tw.WriteHeader(&tar.Header{
+		Name: "file.txt",
+		Size: int64(len(contents)),
+		Uid:  1000,
+		Gid:  1000,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	normalized := normalizeTar(ioutil.NopCloser(&buf), ts)
+	defer normalized.Close()
+
+	tr := tar.NewReader(normalized)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading normalized tar: %v", err)
+	}
+
+	if !hdr.ModTime.Equal(ts) {
+		t.Errorf("ModTime = %v, want %v", hdr.ModTime, ts)
+	}
+	if hdr.Uid != 0 || hdr.Gid != 0 {
+		t.Errorf("Uid/Gid = %d/%d, want 0/0", hdr.Uid, hdr.Gid)
+	}
+
+	got, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatalf("reading normalized file contents: %v", err)
+	}
+	if string(got) != contents {
+		t.Errorf("file contents = %q, want %q", got, contents)
+	}
+}